@@ -27,13 +27,35 @@ type TailscaleDNSServerOptions struct {
 
 type DERPInboundOptions struct {
 	ListenOptions
-	STUNPort uint16 `json:"stun_port,omitempty"`
+	STUNPort   uint16          `json:"stun_port,omitempty"`
+	STUNListen []ListenOptions `json:"stun_listen,omitempty"`
 	InboundTLSOptionsContainer
-	ConfigPath      string                     `json:"config_path,omitempty"`
-	VerifyClientURL badoption.Listable[string] `json:"verify_client_url,omitempty"`
-	MeshWith        []DERPMeshOptions          `json:"mesh_with,omitempty"`
-	MeshPSK         string                     `json:"mesh_psk,omitempty"`
-	MeshPSKFile     string                     `json:"mesh_psk_file,omitempty"`
+	ConfigPath               string                     `json:"config_path,omitempty"`
+	VerifyClientURL          badoption.Listable[string] `json:"verify_client_url,omitempty"`
+	MeshWith                 []DERPMeshOptions          `json:"mesh_with,omitempty"`
+	MeshPSK                  string                     `json:"mesh_psk,omitempty"`
+	MeshPSKFile              string                     `json:"mesh_psk_file,omitempty"`
+	Debug                    bool                       `json:"debug,omitempty"`
+	AcceptConnectionLimit    float64                    `json:"accept_connection_limit,omitempty"`
+	AcceptConnectionBurst    int                        `json:"accept_connection_burst,omitempty"`
+	ClientSendRateLimit      float64                    `json:"client_send_rate_limit,omitempty"`
+	ClientSendRateBurst      int                        `json:"client_send_rate_burst,omitempty"`
+	CertMode                 string                     `json:"cert_mode,omitempty"`
+	CertDirectory            string                     `json:"cert_directory,omitempty"`
+	Hostname                 string                     `json:"hostname,omitempty"`
+	ACMEHTTPPort             uint16                     `json:"acme_http_port,omitempty"`
+	AllowedPublicKeys        badoption.Listable[string] `json:"allowed_public_keys,omitempty"`
+	AllowedKeysFile          string                     `json:"allowed_keys_file,omitempty"`
+	// AuthTokenSecret is not implemented: derp.Server's verify_client_url
+	// hook only ever POSTs {NodePublic}, so a connecting client has no way
+	// to hand an HMAC-signed bearer token through to this callback. Setting
+	// it is rejected at construction time rather than silently ignored; use
+	// AllowedPublicKeys/AllowedKeysFile for offline client authorization.
+	AuthTokenSecret          string                     `json:"auth_token_secret,omitempty"`
+	CaptivePortalChallenge   *bool                      `json:"captive_portal_challenge,omitempty"`
+	UnpublishedDERP          bool                       `json:"unpublished_derp,omitempty"`
+	BootstrapDomains         badoption.Listable[string] `json:"bootstrap_domains,omitempty"`
+	BootstrapRefreshInterval badoption.Duration         `json:"bootstrap_refresh_interval,omitempty"`
 	DialerOptions
 }
 
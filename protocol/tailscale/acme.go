@@ -0,0 +1,146 @@
+package tailscale
+
+import (
+	"context"
+	stdTLS "crypto/tls"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/sagernet/sing-box/common/tls"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeServerConfig implements tls.ServerConfig on top of autocert.Manager,
+// matching upstream derper's `-certmode letsencrypt`: certificates are
+// fetched and cached on demand instead of being supplied ahead of time.
+type acmeServerConfig struct {
+	ctx        context.Context
+	logger     logger.ContextLogger
+	manager    *autocert.Manager
+	httpPort   uint16
+	access     sync.Mutex
+	nextProtos []string
+	httpServer *http.Server
+}
+
+func newACMEServerConfig(ctx context.Context, logger logger.ContextLogger, configPath string, certDirectory string, hostname string, httpPort uint16) (tls.ServerConfig, error) {
+	if hostname == "" {
+		return nil, E.New("missing hostname for cert_mode: letsencrypt")
+	}
+	cacheDirectory := certDirectory
+	if cacheDirectory == "" {
+		cacheDirectory = filepath.Join(filepath.Dir(configPath), "autocert")
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDirectory),
+		HostPolicy: autocert.HostWhitelist(hostname),
+	}
+	if httpPort == 0 {
+		httpPort = 80
+	}
+	return &acmeServerConfig{
+		ctx:      ctx,
+		logger:   logger,
+		manager:  manager,
+		httpPort: httpPort,
+	}, nil
+}
+
+func (c *acmeServerConfig) Start() error {
+	c.httpServer = &http.Server{
+		Addr:    ":" + strconv.Itoa(int(c.httpPort)),
+		Handler: c.manager.HTTPHandler(nil),
+	}
+	go func() {
+		err := c.httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			c.logger.Error(E.Cause(err, "acme: http-01 challenge server"))
+		}
+	}()
+	return nil
+}
+
+func (c *acmeServerConfig) Close() error {
+	if c.httpServer == nil {
+		return nil
+	}
+	return c.httpServer.Close()
+}
+
+func (c *acmeServerConfig) NextProtos() []string {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.nextProtos
+}
+
+func (c *acmeServerConfig) SetNextProtos(nextProtos []string) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.nextProtos = nextProtos
+}
+
+func (c *acmeServerConfig) Config() (*stdTLS.Config, error) {
+	config := c.manager.TLSConfig()
+	config.NextProtos = c.NextProtos()
+	return config, nil
+}
+
+// manualServerConfig implements tls.ServerConfig by reading a static
+// <hostname>.crt/<hostname>.key pair from cert_directory, matching
+// upstream derper's `-certmode manual`.
+type manualServerConfig struct {
+	certificate stdTLS.Certificate
+
+	access     sync.Mutex
+	nextProtos []string
+}
+
+func newManualServerConfig(certDirectory string, hostname string) (tls.ServerConfig, error) {
+	if certDirectory == "" {
+		return nil, E.New("missing cert_directory for cert_mode: manual")
+	}
+	if hostname == "" {
+		return nil, E.New("missing hostname for cert_mode: manual")
+	}
+	certificate, err := stdTLS.LoadX509KeyPair(
+		filepath.Join(certDirectory, hostname+".crt"),
+		filepath.Join(certDirectory, hostname+".key"),
+	)
+	if err != nil {
+		return nil, E.Cause(err, "load manual certificate")
+	}
+	return &manualServerConfig{certificate: certificate}, nil
+}
+
+func (c *manualServerConfig) Start() error {
+	return nil
+}
+
+func (c *manualServerConfig) Close() error {
+	return nil
+}
+
+func (c *manualServerConfig) NextProtos() []string {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.nextProtos
+}
+
+func (c *manualServerConfig) SetNextProtos(nextProtos []string) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.nextProtos = nextProtos
+}
+
+func (c *manualServerConfig) Config() (*stdTLS.Config, error) {
+	return &stdTLS.Config{
+		Certificates: []stdTLS.Certificate{c.certificate},
+		NextProtos:   c.NextProtos(),
+	}, nil
+}
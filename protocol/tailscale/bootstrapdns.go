@@ -0,0 +1,179 @@
+package tailscale
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	"github.com/sagernet/sing/service"
+
+	"github.com/go-chi/render"
+	"github.com/miekg/dns"
+)
+
+const defaultBootstrapRefreshInterval = 10 * time.Minute
+
+// bootstrapDNSCache keeps pre-resolved answers for a configured set of
+// bootstrap domains around in memory, refreshing them on a timer so
+// /bootstrap-dns can keep serving clients through an upstream DNS outage.
+type bootstrapDNSCache struct {
+	ctx          context.Context
+	logger       logger.ContextLogger
+	dnsRouter    adapter.DNSRouter
+	queryOptions adapter.DNSQueryOptions
+	domains      []string
+	refreshEvery time.Duration
+
+	access sync.RWMutex
+	cache  map[string][]netip.Addr
+}
+
+func newBootstrapDNSCache(ctx context.Context, logger logger.ContextLogger, domains []string, refreshEvery time.Duration, queryOptions adapter.DNSQueryOptions) *bootstrapDNSCache {
+	if refreshEvery <= 0 {
+		refreshEvery = defaultBootstrapRefreshInterval
+	}
+	return &bootstrapDNSCache{
+		ctx:          ctx,
+		logger:       logger,
+		dnsRouter:    service.FromContext[adapter.DNSRouter](ctx),
+		queryOptions: queryOptions,
+		domains:      domains,
+		refreshEvery: refreshEvery,
+		cache:        make(map[string][]netip.Addr),
+	}
+}
+
+func (c *bootstrapDNSCache) refresh() {
+	for _, domain := range c.domains {
+		addresses, err := c.dnsRouter.Lookup(c.ctx, domain, c.queryOptions)
+		if err != nil {
+			c.logger.Warn(E.Cause(err, "refresh bootstrap dns for ", domain))
+			continue
+		}
+		c.access.Lock()
+		c.cache[domain] = addresses
+		c.access.Unlock()
+	}
+}
+
+func (c *bootstrapDNSCache) loopRefresh() {
+	c.refresh()
+	ticker := time.NewTicker(c.refreshEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
+
+func (c *bootstrapDNSCache) get(domain string) ([]netip.Addr, bool) {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	addresses, loaded := c.cache[domain]
+	return addresses, loaded
+}
+
+// handleBootstrapDNS serves /bootstrap-dns. It answers with a live lookup,
+// falling back to the pre-resolved cache (if the domain is one of
+// BootstrapDomains) when the upstream lookup fails, and also supports
+// ?format=doh which returns an RFC 8484 DNS-message response for clients
+// that only speak DNS-over-HTTPS.
+func handleBootstrapDNS(ctx context.Context, queryOptions adapter.DNSQueryOptions, cache *bootstrapDNSCache) http.HandlerFunc {
+	dnsRouter := service.FromContext[adapter.DNSRouter](ctx)
+	return func(w http.ResponseWriter, r *http.Request) {
+		queryDomain := r.URL.Query().Get("q")
+		if queryDomain == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "close")
+			w.Write([]byte("{}"))
+			return
+		}
+		addresses, err := dnsRouter.Lookup(ctx, queryDomain, queryOptions)
+		if err != nil {
+			var ok bool
+			addresses, ok = cache.get(queryDomain)
+			if !ok {
+				w.Header().Set("Connection", "close")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		if r.URL.Query().Get("format") == "doh" {
+			serveDoH(w, r, queryDomain, addresses, cache.refreshEvery)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Connection", "close")
+		render.JSON(w, r, render.M{
+			queryDomain: addresses,
+		})
+	}
+}
+
+// serveDoH answers with a single question/record-type pair, since a DoH
+// response carrying (say) AAAA answers under an A question is not a
+// well-formed reply. The question type defaults to whichever family the
+// caller asked for via ?type=A|AAAA, falling back to whichever family is
+// actually present in addresses (A preferred when both are present).
+func serveDoH(w http.ResponseWriter, r *http.Request, domain string, addresses []netip.Addr, refreshEvery time.Duration) {
+	qtype := uint16(dns.TypeA)
+	switch strings.ToUpper(r.URL.Query().Get("type")) {
+	case "AAAA":
+		qtype = dns.TypeAAAA
+	case "A":
+		qtype = dns.TypeA
+	default:
+		if !hasAddrFamily(addresses, true) && hasAddrFamily(addresses, false) {
+			qtype = dns.TypeAAAA
+		}
+	}
+
+	message := new(dns.Msg)
+	message.Id = 0
+	message.Response = true
+	message.RecursionAvailable = true
+	message.Question = []dns.Question{{Name: dns.Fqdn(domain), Qtype: qtype, Qclass: dns.ClassINET}}
+	for _, address := range addresses {
+		isIPv4 := address.Is4() || address.Is4In6()
+		if qtype == dns.TypeA && !isIPv4 {
+			continue
+		}
+		if qtype == dns.TypeAAAA && isIPv4 {
+			continue
+		}
+		header := dns.RR_Header{Name: dns.Fqdn(domain), Class: dns.ClassINET, Rrtype: qtype, Ttl: uint32(refreshEvery.Seconds())}
+		if qtype == dns.TypeA {
+			message.Answer = append(message.Answer, &dns.A{Hdr: header, A: address.AsSlice()})
+		} else {
+			message.Answer = append(message.Answer, &dns.AAAA{Hdr: header, AAAA: address.AsSlice()})
+		}
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(packed)
+}
+
+// hasAddrFamily reports whether addresses contains an IPv4 (v4 true) or
+// IPv6 (v4 false) address.
+func hasAddrFamily(addresses []netip.Addr, v4 bool) bool {
+	for _, address := range addresses {
+		if (address.Is4() || address.Is4In6()) == v4 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package tailscale
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/sagernet/tailscale/derp/derphttp"
+)
+
+// tailscaleChallengeRegex matches the Tailscale-Challenge header format
+// derper validates before echoing it back, guarding against header
+// injection into the Tailscale-Response header.
+var tailscaleChallengeRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// generate204Handler serves /generate_204 the way derper does: an empty
+// 204 response for captive-portal detection, plus the Tailscale-Challenge/
+// Tailscale-Response handshake Tailscale clients use to tell a real
+// connection apart from a captive portal intercepting it.
+func generate204Handler(captivePortalChallenge bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if captivePortalChallenge {
+			if challenge := r.Header.Get("Tailscale-Challenge"); challenge != "" && tailscaleChallengeRegex.MatchString(challenge) {
+				w.Header().Set("Tailscale-Response", "response "+challenge)
+			}
+		}
+		derphttp.ServeNoContent(w, r)
+	}
+}
+
+// probeHandler wraps derphttp.ProbeHandler, optionally refusing requests
+// from user agents that don't look like a Tailscale client, when the
+// server is configured as an unpublished DERP node.
+func probeHandler(unpublished bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if unpublished && !strings.Contains(strings.ToLower(r.UserAgent()), "tailscale") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		derphttp.ProbeHandler(w, r)
+	}
+}
+
+// unpublishedHeaders marks responses as non-indexable, matching derper's
+// behavior for DERP nodes that aren't meant to be publicly discoverable.
+func unpublishedHeaders(base http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex")
+		base.ServeHTTP(w, r)
+	})
+}
@@ -4,11 +4,11 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/netip"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -23,6 +23,7 @@ import (
 	C "github.com/sagernet/sing-box/constant"
 	"github.com/sagernet/sing-box/log"
 	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing-box/protocol/tailscale/stunserver"
 	"github.com/sagernet/sing/common"
 	E "github.com/sagernet/sing/common/exceptions"
 	F "github.com/sagernet/sing/common/format"
@@ -30,20 +31,18 @@ import (
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	aTLS "github.com/sagernet/sing/common/tls"
-	"github.com/sagernet/sing/service"
 	"github.com/sagernet/sing/service/filemanager"
 	"github.com/sagernet/tailscale/derp"
 	"github.com/sagernet/tailscale/derp/derphttp"
 	"github.com/sagernet/tailscale/net/netmon"
-	"github.com/sagernet/tailscale/net/stun"
 	"github.com/sagernet/tailscale/net/wsconn"
 	"github.com/sagernet/tailscale/tsweb"
 	"github.com/sagernet/tailscale/types/key"
 
 	"github.com/coder/websocket"
-	"github.com/go-chi/render"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
 )
 
 func RegisterDERPInbound(registry *inbound.Registry) {
@@ -52,19 +51,30 @@ func RegisterDERPInbound(registry *inbound.Registry) {
 
 type DERPInbound struct {
 	inbound.Adapter
-	ctx             context.Context
-	logger          logger.ContextLogger
-	listener        *listener.Listener
-	stunListener    *listener.Listener
-	dialer          N.Dialer
-	tlsConfig       tls.ServerConfig
-	server          *derp.Server
-	configPath      string
-	verifyClientURL []string
-	home            string
-	meshKey         string
-	meshKeyPath     string
-	meshWith        []option.DERPMeshOptions
+	ctx                      context.Context
+	logger                   logger.ContextLogger
+	listener                 *listener.Listener
+	stunListeners            []*listener.Listener
+	stunServer               *stunserver.STUNServer
+	dialer                   N.Dialer
+	tlsConfig                tls.ServerConfig
+	server                   *derp.Server
+	configPath               string
+	verifyClientURL          []string
+	allowlist                *clientAllowlist
+	home                     string
+	meshKey                  string
+	meshKeyPath              string
+	meshWith                 []option.DERPMeshOptions
+	debug                    bool
+	captivePortal            bool
+	unpublished              bool
+	acceptConnLimit          float64
+	acceptConnBurst          int
+	sendRateLimit            float64
+	sendRateBurst            int
+	bootstrapDomains         []string
+	bootstrapRefreshInterval time.Duration
 }
 
 func NewDERPInbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, options option.DERPInboundOptions) (adapter.Inbound, error) {
@@ -79,16 +89,13 @@ func NewDERPInbound(ctx context.Context, router adapter.Router, logger log.Conte
 		return nil, err
 	}
 
-	stunListenOptions := options.ListenOptions
-	stunListenOptions.ListenPort = options.STUNPort
-
-	if options.TLS == nil || !options.TLS.Enabled {
-		return nil, E.New("TLS is required for DERP server")
-	}
-	tlsConfig, err := tls.NewServer(ctx, logger, common.PtrValueOrDefault(options.TLS))
-	if err != nil {
-		return nil, err
+	var stunListenOptionsList []option.ListenOptions
+	if options.STUNPort != 0 {
+		stunListenOptions := options.ListenOptions
+		stunListenOptions.ListenPort = options.STUNPort
+		stunListenOptionsList = append(stunListenOptionsList, stunListenOptions)
 	}
+	stunListenOptionsList = append(stunListenOptionsList, options.STUNListen...)
 
 	var configPath string
 	if options.ConfigPath != "" {
@@ -99,6 +106,21 @@ func NewDERPInbound(ctx context.Context, router adapter.Router, logger log.Conte
 		return nil, E.New("missing config_path")
 	}
 
+	var tlsConfig tls.ServerConfig
+	switch {
+	case options.TLS != nil && options.TLS.Enabled:
+		tlsConfig, err = tls.NewServer(ctx, logger, common.PtrValueOrDefault(options.TLS))
+	case options.CertMode == "letsencrypt":
+		tlsConfig, err = newACMEServerConfig(ctx, logger, configPath, options.CertDirectory, options.Hostname, options.ACMEHTTPPort)
+	case options.CertMode == "manual":
+		tlsConfig, err = newManualServerConfig(options.CertDirectory, options.Hostname)
+	default:
+		return nil, E.New("TLS is required for DERP server")
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	if options.MeshPSK != "" {
 		err = checkMeshKey(options.MeshPSK)
 		if err != nil {
@@ -106,6 +128,28 @@ func NewDERPInbound(ctx context.Context, router adapter.Router, logger log.Conte
 		}
 	}
 
+	if options.AuthTokenSecret != "" {
+		return nil, E.New("auth_token_secret is not supported: derp.Server has no channel for a client to present a bearer token to verify_client_url, only its node public key; use allowed_public_keys or allowed_keys_file instead")
+	}
+
+	var allowlist *clientAllowlist
+	if len(options.AllowedPublicKeys) > 0 || options.AllowedKeysFile != "" {
+		allowlist, err = newClientAllowlist(logger, options.AllowedPublicKeys, options.AllowedKeysFile)
+		if err != nil {
+			return nil, E.Cause(err, "parse client allowlist")
+		}
+	}
+
+	stunListeners := make([]*listener.Listener, len(stunListenOptionsList))
+	for i, stunListenOptions := range stunListenOptionsList {
+		stunListeners[i] = listener.New(listener.Options{
+			Context: ctx,
+			Logger:  logger,
+			Network: []string{N.NetworkTCP},
+			Listen:  stunListenOptions,
+		})
+	}
+
 	return &DERPInbound{
 		Adapter: inbound.NewAdapter(C.TypeDERP, tag),
 		ctx:     ctx,
@@ -116,19 +160,25 @@ func NewDERPInbound(ctx context.Context, router adapter.Router, logger log.Conte
 			Network: []string{N.NetworkTCP},
 			Listen:  options.ListenOptions,
 		}),
-		stunListener: listener.New(listener.Options{
-			Context: ctx,
-			Logger:  logger,
-			Network: []string{N.NetworkTCP},
-			Listen:  stunListenOptions,
-		}),
-		dialer:          outboundDialer,
-		tlsConfig:       tlsConfig,
-		configPath:      configPath,
-		verifyClientURL: options.VerifyClientURL,
-		meshKey:         options.MeshPSK,
-		meshKeyPath:     options.MeshPSKFile,
-		meshWith:        options.MeshWith,
+		stunListeners:            stunListeners,
+		stunServer:               stunserver.New(logger),
+		dialer:                   outboundDialer,
+		tlsConfig:                tlsConfig,
+		configPath:               configPath,
+		verifyClientURL:          options.VerifyClientURL,
+		allowlist:                allowlist,
+		meshKey:                  options.MeshPSK,
+		meshKeyPath:              options.MeshPSKFile,
+		meshWith:                 options.MeshWith,
+		debug:                    options.Debug,
+		acceptConnLimit:          options.AcceptConnectionLimit,
+		acceptConnBurst:          options.AcceptConnectionBurst,
+		sendRateLimit:            options.ClientSendRateLimit,
+		sendRateBurst:            options.ClientSendRateBurst,
+		captivePortal:            options.CaptivePortalChallenge == nil || *options.CaptivePortalChallenge,
+		unpublished:              options.UnpublishedDERP,
+		bootstrapDomains:         options.BootstrapDomains,
+		bootstrapRefreshInterval: time.Duration(options.BootstrapRefreshInterval),
 	}, nil
 }
 
@@ -143,15 +193,27 @@ func (d *DERPInbound) Start(stage adapter.StartStage) error {
 		server := derp.NewServer(config.PrivateKey, func(format string, args ...any) {
 			d.logger.Debug(fmt.Sprintf(format, args...))
 		})
-		server.SetVerifyClientHTTPClient(&http.Client{
-			Transport: &http.Transport{
-				ForceAttemptHTTP2: true,
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return d.dialer.DialContext(ctx, network, M.ParseSocksaddr(addr))
+		if d.allowlist != nil {
+			server.SetVerifyClientHTTPClient(d.allowlist.httpClient())
+			server.SetVerifyClientURL([]string{"local://allowlist"})
+			if d.allowlist.keysFile != "" {
+				go d.allowlist.loopReload(d.ctx, 30*time.Second)
+			}
+		} else {
+			server.SetVerifyClientHTTPClient(&http.Client{
+				Transport: &http.Transport{
+					ForceAttemptHTTP2: true,
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						return d.dialer.DialContext(ctx, network, M.ParseSocksaddr(addr))
+					},
 				},
-			},
-		})
-		server.SetVerifyClientURL(d.verifyClientURL)
+			})
+			server.SetVerifyClientURL(d.verifyClientURL)
+		}
+
+		if d.sendRateLimit > 0 {
+			server.SetClientSendRateLimit(rate.Limit(d.sendRateLimit), d.sendRateBurst)
+		}
 
 		if d.meshKey != "" {
 			server.SetMeshKey(d.meshKey)
@@ -179,9 +241,13 @@ func (d *DERPInbound) Start(stage adapter.StartStage) error {
 			return E.New("invalid home value: ", d.home)
 		}
 
-		derpMux.HandleFunc("/derp/probe", derphttp.ProbeHandler)
+		derpMux.HandleFunc("/derp/probe", probeHandler(d.unpublished))
 		derpMux.HandleFunc("/derp/latency-check", derphttp.ProbeHandler)
-		derpMux.HandleFunc("/bootstrap-dns", tsweb.BrowserHeaderHandlerFunc(handleBootstrapDNS(d.ctx, d.dialer.(dialer.ResolveDialer).QueryOptions())))
+		bootstrapCache := newBootstrapDNSCache(d.ctx, d.logger, d.bootstrapDomains, d.bootstrapRefreshInterval, d.dialer.(dialer.ResolveDialer).QueryOptions())
+		if len(d.bootstrapDomains) > 0 {
+			go bootstrapCache.loopRefresh()
+		}
+		derpMux.HandleFunc("/bootstrap-dns", tsweb.BrowserHeaderHandlerFunc(handleBootstrapDNS(d.ctx, d.dialer.(dialer.ResolveDialer).QueryOptions(), bootstrapCache)))
 		derpMux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			tsweb.AddBrowserHeaders(w)
 			homeHandler.ServeHTTP(w, r)
@@ -190,7 +256,14 @@ func (d *DERPInbound) Start(stage adapter.StartStage) error {
 			tsweb.AddBrowserHeaders(w)
 			io.WriteString(w, "User-agent: *\nDisallow: /\n")
 		}))
-		derpMux.Handle("/generate_204", http.HandlerFunc(derphttp.ServeNoContent))
+		derpMux.Handle("/generate_204", generate204Handler(d.captivePortal))
+
+		if d.debug {
+			publishExpVar("derp_"+d.Tag(), server.ExpVar())
+			publishExpVar("stun_"+d.Tag(), d.stunServer.ExpVar())
+			tsweb.Debugger(derpMux)
+			derpMux.Handle("/metrics", tsweb.VarzHandler)
+		}
 
 		err = d.tlsConfig.Start()
 		if err != nil {
@@ -201,23 +274,33 @@ func (d *DERPInbound) Start(stage adapter.StartStage) error {
 		if err != nil {
 			return err
 		}
+		tcpListener = newRateLimitedListener(d.ctx, tcpListener, d.logger, d.acceptConnLimit, d.acceptConnBurst)
 		if len(d.tlsConfig.NextProtos()) == 0 {
 			d.tlsConfig.SetNextProtos([]string{http2.NextProtoTLS, "http/1.1"})
 		} else if !common.Contains(d.tlsConfig.NextProtos(), http2.NextProtoTLS) {
 			d.tlsConfig.SetNextProtos(append([]string{http2.NextProtoTLS}, d.tlsConfig.NextProtos()...))
 		}
 		tcpListener = aTLS.NewListener(tcpListener, d.tlsConfig)
+		var muxHandler http.Handler = derpMux
+		if d.unpublished {
+			muxHandler = unpublishedHeaders(muxHandler)
+		}
 		httpServer := &http.Server{
-			Handler: h2c.NewHandler(derpMux, &http2.Server{}),
+			Handler: h2c.NewHandler(muxHandler, &http2.Server{}),
 		}
 		go httpServer.Serve(tcpListener)
 
-		if d.stunListener.ListenOptions().ListenPort != 0 {
-			packetConn, err := d.stunListener.ListenUDP()
+		for _, stunListener := range d.stunListeners {
+			packetConn, err := stunListener.ListenUDP()
 			if err != nil {
 				return err
 			}
-			go d.loopSTUN(packetConn.(*net.UDPConn))
+			go func() {
+				err := d.stunServer.ListenAndServe(packetConn)
+				if err != nil && !E.IsClosedOrCanceled(err) {
+					d.logger.Error(E.Cause(err, "stun server"))
+				}
+			}()
 		}
 	case adapter.StartStatePostStart:
 		if len(d.meshWith) > 0 {
@@ -291,11 +374,14 @@ func (d *DERPInbound) startMeshWithHost(derpServer *derp.Server, server option.D
 }
 
 func (d *DERPInbound) Close() error {
-	return common.Close(
+	closers := []io.Closer{
 		common.PtrOrNil(d.listener),
-		common.PtrOrNil(d.stunListener),
 		d.tlsConfig,
-	)
+	}
+	for _, stunListener := range d.stunListeners {
+		closers = append(closers, stunListener)
+	}
+	return common.Close(closers...)
 }
 
 var homePage = `
@@ -323,6 +409,19 @@ var homePage = `
 </html>
 `
 
+// publishExpVar registers v under name, skipping the call if name is
+// already registered. expvar.Publish panics on a duplicate name, which
+// would otherwise crash the process whenever two debug-enabled DERP
+// inbounds share a tag-derived name or this inbound is restarted in
+// place (config reload); the tradeoff is that a restarted inbound's
+// debug vars keep pointing at the pre-restart server/stun instances.
+func publishExpVar(name string, v expvar.Var) {
+	if expvar.Get(name) != nil {
+		return
+	}
+	expvar.Publish(name, v)
+}
+
 func getHomeHandler(val string) (_ http.Handler, ok bool) {
 	if val == "" {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -379,54 +478,6 @@ func addWebSocketSupport(s *derp.Server, base http.Handler) http.Handler {
 	})
 }
 
-func handleBootstrapDNS(ctx context.Context, queryOptions adapter.DNSQueryOptions) http.HandlerFunc {
-	dnsRouter := service.FromContext[adapter.DNSRouter](ctx)
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Connection", "close")
-		if queryDomain := r.URL.Query().Get("q"); queryDomain != "" {
-			addresses, err := dnsRouter.Lookup(ctx, queryDomain, queryOptions)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			render.JSON(w, r, render.M{
-				queryDomain: addresses,
-			})
-			return
-		}
-		w.Write([]byte("{}"))
-	}
-}
-
-func (d *DERPInbound) loopSTUN(packetConn *net.UDPConn) {
-	var buffer [64 << 10]byte
-	var (
-		n        int
-		addrPort netip.AddrPort
-		err      error
-	)
-	for {
-		n, addrPort, err = packetConn.ReadFromUDPAddrPort(buffer[:])
-		if err != nil {
-			if E.IsClosedOrCanceled(err) {
-				return
-			}
-			time.Sleep(time.Second)
-			continue
-		}
-		pkt := buffer[:n]
-		if !stun.Is(pkt) {
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			continue
-		}
-		packetConn.WriteToUDPAddrPort(stun.Response(txid, addrPort), addrPort)
-	}
-}
-
 type derpConfig struct {
 	PrivateKey key.NodePrivate
 }
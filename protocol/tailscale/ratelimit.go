@@ -0,0 +1,49 @@
+package tailscale
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/logger"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedListener wraps a net.Listener and throttles the rate at which
+// new connections are accepted, mirroring derper's -accept-connection-limit
+// and -accept-connection-burst flags: connections over the limit are queued
+// and delayed via limiter.Wait rather than rejected outright.
+type rateLimitedListener struct {
+	net.Listener
+	ctx     context.Context
+	logger  logger.ContextLogger
+	limiter *rate.Limiter
+}
+
+func newRateLimitedListener(ctx context.Context, listener net.Listener, logger logger.ContextLogger, limit float64, burst int) net.Listener {
+	if limit <= 0 {
+		return listener
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimitedListener{
+		Listener: listener,
+		ctx:      ctx,
+		logger:   logger,
+		limiter:  rate.NewLimiter(rate.Limit(limit), burst),
+	}
+}
+
+func (l *rateLimitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	err = l.limiter.Wait(l.ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,184 @@
+// Package stunserver implements the STUN half of a DERP node as a
+// standalone UDP subsystem, mirroring upstream tailscale's net/stunserver:
+// a small worker pool reading one shared socket, with expvar counters for
+// observability and no dependency on the rest of protocol/tailscale.
+package stunserver
+
+import (
+	"expvar"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	"github.com/sagernet/tailscale/net/stun"
+
+	"golang.org/x/net/ipv4"
+)
+
+// batchSize is the number of packets read/written per recvmmsg/sendmmsg
+// syscall when batch I/O is available. x/net/ipv4 falls back to one
+// syscall per message on platforms that don't support batching, so this
+// is safe to use unconditionally.
+const batchSize = 8
+
+// STUNServer answers STUN binding requests on a UDP socket, the same
+// request/response pair that tailscaled uses for NAT traversal.
+type STUNServer struct {
+	logger logger.ContextLogger
+
+	readErrors expvar.Int
+	badPackets expvar.Int
+	successes  expvar.Int
+	packetsV4  expvar.Int
+	packetsV6  expvar.Int
+}
+
+func New(logger logger.ContextLogger) *STUNServer {
+	return &STUNServer{logger: logger}
+}
+
+// ListenAndServe reads from pc until it is closed, answering STUN binding
+// requests. It blocks; callers that want a background server should run it
+// in its own goroutine. Workers are sized by GOMAXPROCS since net.PacketConn
+// implementations are safe for concurrent use from multiple goroutines.
+//
+// When pc is a *net.UDPConn, reads and writes are batched via
+// golang.org/x/net/ipv4 (recvmmsg/sendmmsg on Linux) to cut per-packet
+// syscall overhead under load; otherwise it falls back to a plain
+// ReadFrom/WriteTo loop.
+func (s *STUNServer) ListenAndServe(pc net.PacketConn) error {
+	workers := runtime.GOMAXPROCS(0)
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(workers)
+	if udpConn, isUDP := pc.(*net.UDPConn); isUDP {
+		batchConn := ipv4.NewPacketConn(udpConn)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer waitGroup.Done()
+				s.batchLoop(batchConn)
+			}()
+		}
+	} else {
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer waitGroup.Done()
+				s.loop(pc)
+			}()
+		}
+	}
+	waitGroup.Wait()
+	return nil
+}
+
+func (s *STUNServer) loop(pc net.PacketConn) {
+	var buffer [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buffer[:])
+		if err != nil {
+			if E.IsClosedOrCanceled(err) {
+				return
+			}
+			s.readErrors.Add(1)
+			time.Sleep(time.Second)
+			continue
+		}
+		packet := buffer[:n]
+		if !stun.Is(packet) {
+			s.badPackets.Add(1)
+			continue
+		}
+		txID, err := stun.ParseBindingRequest(packet)
+		if err != nil {
+			s.badPackets.Add(1)
+			continue
+		}
+		addrPort, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			s.badPackets.Add(1)
+			continue
+		}
+		if addrPort.Addr().Is4() || addrPort.Addr().Is4In6() {
+			s.packetsV4.Add(1)
+		} else {
+			s.packetsV6.Add(1)
+		}
+		_, err = pc.WriteTo(stun.Response(txID, addrPort), addr)
+		if err != nil {
+			continue
+		}
+		s.successes.Add(1)
+	}
+}
+
+// batchLoop is the ReadBatch/WriteBatch counterpart of loop, used whenever
+// the underlying socket is a *net.UDPConn.
+func (s *STUNServer) batchLoop(batchConn *ipv4.PacketConn) {
+	messages := make([]ipv4.Message, batchSize)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, 64<<10)}
+	}
+	replies := make([]ipv4.Message, 0, batchSize)
+	for {
+		n, err := batchConn.ReadBatch(messages, 0)
+		if err != nil {
+			if E.IsClosedOrCanceled(err) {
+				return
+			}
+			s.readErrors.Add(1)
+			time.Sleep(time.Second)
+			continue
+		}
+		replies = replies[:0]
+		for i := 0; i < n; i++ {
+			message := messages[i]
+			packet := message.Buffers[0][:message.N]
+			if !stun.Is(packet) {
+				s.badPackets.Add(1)
+				continue
+			}
+			txID, err := stun.ParseBindingRequest(packet)
+			if err != nil {
+				s.badPackets.Add(1)
+				continue
+			}
+			addrPort, err := netip.ParseAddrPort(message.Addr.String())
+			if err != nil {
+				s.badPackets.Add(1)
+				continue
+			}
+			if addrPort.Addr().Is4() || addrPort.Addr().Is4In6() {
+				s.packetsV4.Add(1)
+			} else {
+				s.packetsV6.Add(1)
+			}
+			replies = append(replies, ipv4.Message{
+				Buffers: [][]byte{stun.Response(txID, addrPort)},
+				Addr:    message.Addr,
+			})
+		}
+		if len(replies) == 0 {
+			continue
+		}
+		sent, err := batchConn.WriteBatch(replies, 0)
+		if err != nil && sent == 0 {
+			continue
+		}
+		s.successes.Add(int64(sent))
+	}
+}
+
+// ExpVar exposes stun_readerr/stun_badpacket/stun_success and per-IP-family
+// packet counters, the same names upstream derper publishes under /debug/varz.
+func (s *STUNServer) ExpVar() expvar.Var {
+	m := new(expvar.Map).Init()
+	m.Set("stun_readerr", &s.readErrors)
+	m.Set("stun_badpacket", &s.badPackets)
+	m.Set("stun_success", &s.successes)
+	m.Set("stun_packets_v4", &s.packetsV4)
+	m.Set("stun_packets_v6", &s.packetsV6)
+	return m
+}
@@ -0,0 +1,152 @@
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	"github.com/sagernet/tailscale/types/key"
+)
+
+// verifyClientRequest/verifyClientResponse mirror the JSON protocol that
+// derp.Server speaks to the verify_client_url endpoint, so that a local
+// allowlist can plug into the same hook without standing up a real HTTP
+// server.
+type verifyClientRequest struct {
+	NodePublic key.NodePublic
+}
+
+type verifyClientResponse struct {
+	Allow bool
+}
+
+// clientAllowlist authorizes DERP clients against a local set of node
+// public keys, instead of delegating to an external verify_client_url
+// endpoint. Keys can be given inline (AllowedPublicKeys) or loaded from a
+// file that is periodically reloaded, so operators can update the
+// allowlist without restarting the inbound.
+type clientAllowlist struct {
+	logger   logger.ContextLogger
+	keysFile string
+
+	access sync.RWMutex
+	keys   map[key.NodePublic]bool
+}
+
+func newClientAllowlist(logger logger.ContextLogger, inlineKeys []string, keysFile string) (*clientAllowlist, error) {
+	allowlist := &clientAllowlist{
+		logger:   logger,
+		keysFile: keysFile,
+		keys:     make(map[key.NodePublic]bool),
+	}
+	for _, keyString := range inlineKeys {
+		nodeKey, err := parseNodePublic(keyString)
+		if err != nil {
+			return nil, E.Cause(err, "parse allowed_public_keys entry")
+		}
+		allowlist.keys[nodeKey] = true
+	}
+	if keysFile != "" {
+		err := allowlist.reload()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return allowlist, nil
+}
+
+func parseNodePublic(value string) (key.NodePublic, error) {
+	var nodeKey key.NodePublic
+	err := nodeKey.UnmarshalText([]byte(strings.TrimSpace(value)))
+	if err != nil {
+		return key.NodePublic{}, err
+	}
+	return nodeKey, nil
+}
+
+func (a *clientAllowlist) reload() error {
+	content, err := os.ReadFile(a.keysFile)
+	if err != nil {
+		return E.Cause(err, "read allowed_keys_file")
+	}
+	keys := make(map[key.NodePublic]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nodeKey, err := parseNodePublic(line)
+		if err != nil {
+			return E.Cause(err, "parse allowed_keys_file entry")
+		}
+		keys[nodeKey] = true
+	}
+	a.access.Lock()
+	a.keys = keys
+	a.access.Unlock()
+	return nil
+}
+
+// loopReload periodically re-reads keysFile so updates take effect without
+// a restart. A failed reload is logged and the previous key set is kept.
+func (a *clientAllowlist) loopReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := a.reload()
+			if err != nil {
+				a.logger.Error(E.Cause(err, "reload allowed_keys_file"))
+			}
+		}
+	}
+}
+
+func (a *clientAllowlist) allowed(nodeKey key.NodePublic) bool {
+	a.access.RLock()
+	defer a.access.RUnlock()
+	return a.keys[nodeKey]
+}
+
+// httpClient returns an *http.Client whose RoundTrip is served entirely
+// in-process, so derp.Server's existing verify_client_url hook can be
+// reused for local verification without an outbound HTTP request.
+func (a *clientAllowlist) httpClient() *http.Client {
+	return &http.Client{Transport: a}
+}
+
+func (a *clientAllowlist) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body verifyClientRequest
+	if req.Body != nil {
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(content, &body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	allow := a.allowed(body.NodePublic)
+	responseBody, err := json.Marshal(verifyClientResponse{Allow: allow})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(responseBody)),
+		Request:    req,
+	}, nil
+}